@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+// mdCompactableServer is the interface an MD server backend must
+// implement for `md compact` to work against it; mdCompactOne returns
+// an error for any backend that doesn't. None of the MDServer
+// implementations in libkbfs implement it.
+type mdCompactableServer interface {
+	Snapshot(ctx context.Context, tlfID tlf.ID, bid libkbfs.BranchID,
+		upTo libkbfs.MetadataRevision) (libkbfs.SnapshotID, error)
+	Compact(ctx context.Context, tlfID tlf.ID, bid libkbfs.BranchID,
+		snap libkbfs.SnapshotID) error
+}
+
+func mdCompactOne(
+	ctx context.Context, config libkbfs.Config, tlfPath string,
+	keep uint64, dryRun, force bool) error {
+	handle, err := parseTLFPath(ctx, config.KBPKI(), tlfPath)
+	if err != nil {
+		return err
+	}
+
+	server, ok := config.MDServer().(mdCompactableServer)
+	if !ok {
+		return fmt.Errorf(
+			"%T doesn't support compaction", config.MDServer())
+	}
+
+	fmt.Printf("Getting latest metadata...\n")
+
+	_, irmd, err := config.MDOps().GetForHandle(ctx, handle, libkbfs.Merged)
+	if err != nil {
+		return err
+	}
+	if irmd == (libkbfs.ImmutableRootMetadata{}) {
+		fmt.Printf("No TLF found for %q\n", tlfPath)
+		return nil
+	}
+
+	latest := irmd.Revision()
+	if uint64(latest) <= keep {
+		fmt.Printf(
+			"Only %d revisions exist, which is <= -keep=%d; nothing to do\n",
+			latest, keep)
+		return nil
+	}
+	// Compact keeps upTo itself, so revisions upTo..latest -- keep of
+	// them -- are left.
+	upTo := latest - libkbfs.MetadataRevision(keep) + 1
+
+	fmt.Printf(
+		"Will snapshot and compact revisions before %d for %s, keeping the latest %d\n",
+		upTo, tlfPath, keep)
+
+	if dryRun {
+		fmt.Print("Dry-run set; not doing anything\n")
+		return nil
+	}
+
+	if !force {
+		fmt.Print("Are you sure you want to continue? [y/N]: ")
+		response, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			return err
+		}
+		response = strings.ToLower(strings.TrimSpace(response))
+		if response != "y" {
+			fmt.Printf("Didn't confirm; not doing anything\n")
+			return nil
+		}
+	}
+
+	snap, err := server.Snapshot(
+		ctx, irmd.TlfID(), libkbfs.NullBranchID, upTo)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote snapshot %s\n", snap)
+
+	err = server.Compact(ctx, irmd.TlfID(), libkbfs.NullBranchID, snap)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Compacted revisions before %d\n", upTo)
+
+	return nil
+}
+
+const mdCompactUsageStr = `Usage:
+  kbfstool md compact /keybase/[public|private]/user1,assertion2
+
+`
+
+func mdCompact(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs md compact", flag.ContinueOnError)
+	keep := flags.Uint64("keep", 1000, "Number of most recent revisions to leave uncompacted.")
+	dryRun := flags.Bool("d", false, "Dry run: don't actually do anything.")
+	force := flags.Bool("f", false, "If set, skip confirmation prompt.")
+	err := flags.Parse(args)
+	if err != nil {
+		printError("md compact", err)
+		return 1
+	}
+
+	inputs := flags.Args()
+	if len(inputs) != 1 {
+		fmt.Print(mdCompactUsageStr)
+		return 1
+	}
+
+	err = mdCompactOne(ctx, config, inputs[0], *keep, *dryRun, *force)
+	if err != nil {
+		printError("md compact", err)
+		return 1
+	}
+
+	fmt.Print("\n")
+
+	return 0
+}
@@ -0,0 +1,278 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/tlf"
+)
+
+// MDJournal is an observability hook for mdServerTlfStorage: it is
+// given an explicit chance to record every put, every get, and every
+// rejected request, rather than those events happening silently
+// under mdServerTlfStorage's lock. It is passed in to
+// makeMDServerTlfStorage rather than pulled from a package-global, so
+// that multiple mdServerTlfStorage instances -- as in a test running
+// several under -race -- can each have their own, independent sink.
+type MDJournal interface {
+	// RecordPut is called after a new MD revision has been
+	// successfully written to disk.
+	RecordPut(tlfID tlf.ID, bid BranchID, rev MetadataRevision,
+		mdID MdID, uid keybase1.UID, ts time.Time)
+	// RecordGet is called after getForTLF has successfully read a
+	// branch head and is returning it to a caller. Revisions returned
+	// by getRange are not recorded.
+	RecordGet(tlfID tlf.ID, bid BranchID, rev MetadataRevision,
+		mdID MdID, uid keybase1.UID, ts time.Time)
+	// RecordReject is called on every error-returning branch of a
+	// put, and on every error-returning branch of a get's permission
+	// check (checkGetParamsReadLocked), with a short human-readable
+	// reason and the underlying error. A request refused up front
+	// because the server is already shut down is not recorded, and
+	// neither is a get that fails after passing its permission check.
+	RecordReject(reason string, err error)
+	// Close releases any resources (e.g. open files) held by the
+	// journal. It is called once, when the owning
+	// mdServerTlfStorage is shut down.
+	Close() error
+}
+
+// JournalEntryKind identifies which MDJournal method produced a given
+// JournalEntry.
+type JournalEntryKind int
+
+const (
+	JournalEntryPut JournalEntryKind = iota + 1
+	JournalEntryGet
+	JournalEntryReject
+)
+
+// JournalEntry is the on-disk representation of a single MDJournal
+// event, as written by FSJournal and read back by Replay.
+type JournalEntry struct {
+	Kind   JournalEntryKind
+	TlfID  tlf.ID
+	Bid    BranchID
+	Rev    MetadataRevision
+	MdID   MdID
+	UID    keybase1.UID
+	Ts     time.Time
+	Reason string
+	Err    string
+}
+
+// NilJournal is an MDJournal that records nothing. It is the default
+// used by makeMDServerTlfStorage when no journal is supplied.
+type NilJournal struct{}
+
+var _ MDJournal = NilJournal{}
+
+// RecordPut implements the MDJournal interface for NilJournal.
+func (NilJournal) RecordPut(
+	tlf.ID, BranchID, MetadataRevision, MdID, keybase1.UID, time.Time) {
+}
+
+// RecordGet implements the MDJournal interface for NilJournal.
+func (NilJournal) RecordGet(
+	tlf.ID, BranchID, MetadataRevision, MdID, keybase1.UID, time.Time) {
+}
+
+// RecordReject implements the MDJournal interface for NilJournal.
+func (NilJournal) RecordReject(string, error) {}
+
+// Close implements the MDJournal interface for NilJournal.
+func (NilJournal) Close() error { return nil }
+
+// FSJournal is an MDJournal that appends each event as a
+// length-prefixed msgpack-encoded JournalEntry to a file, rotating to
+// a new file once the current one has reached maxFileBytes. A length
+// prefix, rather than a newline delimiter, is required because
+// msgpack is a binary encoding: a 32-byte MdID/UID or an error string
+// can legitimately contain a '\n' byte.
+type FSJournal struct {
+	codec        kbfscodec.Codec
+	dir          string
+	maxFileBytes int64
+
+	lock        sync.Mutex
+	f           *os.File
+	w           *bufio.Writer
+	currentSize int64
+	generation  int
+}
+
+// NewFSJournal creates an FSJournal that writes rotating files named
+// audit.<generation>.mpack under dir. maxFileBytes <= 0 means never
+// rotate.
+func NewFSJournal(codec kbfscodec.Codec, dir string, maxFileBytes int64) (
+	*FSJournal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	j := &FSJournal{
+		codec:        codec,
+		dir:          dir,
+		maxFileBytes: maxFileBytes,
+	}
+	if err := j.openLocked(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *FSJournal) currentPathLocked() string {
+	return filepath.Join(j.dir, fmt.Sprintf("audit.%d.mpack", j.generation))
+}
+
+func (j *FSJournal) openLocked() error {
+	f, err := os.OpenFile(
+		j.currentPathLocked(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	j.f = f
+	j.w = bufio.NewWriter(f)
+	j.currentSize = info.Size()
+	return nil
+}
+
+func (j *FSJournal) writeLocked(entry JournalEntry) error {
+	if j.maxFileBytes > 0 && j.currentSize >= j.maxFileBytes {
+		if err := j.w.Flush(); err != nil {
+			return err
+		}
+		if err := j.f.Close(); err != nil {
+			return err
+		}
+		j.generation++
+		if err := j.openLocked(); err != nil {
+			return err
+		}
+	}
+
+	encoded, err := j.codec.Encode(entry)
+	if err != nil {
+		return err
+	}
+	n, err := writeJournalRecord(j.w, encoded)
+	if err != nil {
+		return err
+	}
+	j.currentSize += int64(n)
+	return j.w.Flush()
+}
+
+// RecordPut implements the MDJournal interface for FSJournal.
+func (j *FSJournal) RecordPut(tlfID tlf.ID, bid BranchID, rev MetadataRevision,
+	mdID MdID, uid keybase1.UID, ts time.Time) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	_ = j.writeLocked(JournalEntry{
+		Kind: JournalEntryPut, TlfID: tlfID, Bid: bid, Rev: rev,
+		MdID: mdID, UID: uid, Ts: ts,
+	})
+}
+
+// RecordGet implements the MDJournal interface for FSJournal.
+func (j *FSJournal) RecordGet(tlfID tlf.ID, bid BranchID, rev MetadataRevision,
+	mdID MdID, uid keybase1.UID, ts time.Time) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	_ = j.writeLocked(JournalEntry{
+		Kind: JournalEntryGet, TlfID: tlfID, Bid: bid, Rev: rev,
+		MdID: mdID, UID: uid, Ts: ts,
+	})
+}
+
+// RecordReject implements the MDJournal interface for FSJournal.
+func (j *FSJournal) RecordReject(reason string, err error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	errStr := ""
+	if err != nil {
+		errStr = err.Error()
+	}
+	_ = j.writeLocked(JournalEntry{
+		Kind: JournalEntryReject, Reason: reason, Err: errStr,
+	})
+}
+
+// Close implements the MDJournal interface for FSJournal.
+func (j *FSJournal) Close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if err := j.w.Flush(); err != nil {
+		j.f.Close()
+		return err
+	}
+	return j.f.Close()
+}
+
+// writeJournalRecord writes encoded to w as a single record: a 4-byte
+// big-endian length prefix followed by encoded itself. It returns the
+// total number of bytes written, including the prefix.
+func writeJournalRecord(w io.Writer, encoded []byte) (int, error) {
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(encoded)))
+	if _, err := w.Write(lenBuf[:]); err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(encoded); err != nil {
+		return 0, err
+	}
+	return len(lenBuf) + len(encoded), nil
+}
+
+// readJournalRecord reads back a single record written by
+// writeJournalRecord.
+func readJournalRecord(r io.Reader) ([]byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	encoded := make([]byte, binary.BigEndian.Uint32(lenBuf[:]))
+	if _, err := io.ReadFull(r, encoded); err != nil {
+		return nil, err
+	}
+	return encoded, nil
+}
+
+// Replay reads back a stream of length-prefixed msgpack JournalEntry
+// records written by an FSJournal, for offline analysis.
+func Replay(codec kbfscodec.Codec, r io.Reader) ([]JournalEntry, error) {
+	br := bufio.NewReader(r)
+
+	var entries []JournalEntry
+	for {
+		encoded, err := readJournalRecord(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var entry JournalEntry
+		if err := codec.Decode(encoded, &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
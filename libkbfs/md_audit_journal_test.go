@@ -0,0 +1,97 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+// TestFSJournalReplayRoundTrip writes a handful of entries -- including
+// one whose Err string contains a raw '\n' byte, which a
+// newline-delimited encoding would mistake for a record boundary --
+// and checks that Replay reads back exactly what was written.
+func TestFSJournalReplayRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "md_audit_journal_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	codec := kbfscodec.NewMsgpackCodec()
+	j, err := NewFSJournal(codec, dir, 0)
+	require.NoError(t, err)
+
+	tlfID := tlf.FakeID(1, tlf.Private)
+	ts := time.Unix(1234, 0)
+
+	j.RecordPut(tlfID, NullBranchID, MetadataRevision(1), MdID{}, keybase1.UID(""), ts)
+	j.RecordGet(tlfID, NullBranchID, MetadataRevision(1), MdID{}, keybase1.UID(""), ts)
+	j.RecordReject("bad request", errors.New("line one\nline two"))
+
+	require.NoError(t, j.Close())
+
+	f, err := os.Open(filepath.Join(dir, "audit.0.mpack"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	entries, err := Replay(codec, f)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+
+	require.Equal(t, JournalEntryPut, entries[0].Kind)
+	require.Equal(t, JournalEntryGet, entries[1].Kind)
+	require.Equal(t, JournalEntryReject, entries[2].Kind)
+	require.Equal(t, "bad request", entries[2].Reason)
+	require.Equal(t, "line one\nline two", entries[2].Err)
+}
+
+// TestFSJournalReplayRotation checks that Replay can read back entries
+// spanning more than one generation file after rotation.
+func TestFSJournalReplayRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "md_audit_journal_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	codec := kbfscodec.NewMsgpackCodec()
+	// A tiny maxFileBytes forces rotation after the very first entry.
+	j, err := NewFSJournal(codec, dir, 1)
+	require.NoError(t, err)
+
+	tlfID := tlf.FakeID(1, tlf.Private)
+	ts := time.Unix(0, 0)
+	for i := 0; i < 5; i++ {
+		j.RecordPut(
+			tlfID, NullBranchID, MetadataRevision(i), MdID{}, keybase1.UID(""), ts)
+	}
+	require.NoError(t, j.Close())
+
+	var all []JournalEntry
+	for gen := 0; ; gen++ {
+		path := filepath.Join(dir, fmt.Sprintf("audit.%d.mpack", gen))
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			break
+		}
+		require.NoError(t, err)
+		entries, err := Replay(codec, bytes.NewReader(data))
+		require.NoError(t, err)
+		all = append(all, entries...)
+	}
+
+	require.Len(t, all, 5)
+	for i, entry := range all {
+		require.Equal(t, MetadataRevision(i), entry.Rev)
+	}
+}
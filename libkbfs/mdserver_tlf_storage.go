@@ -7,8 +7,11 @@ package libkbfs
 import (
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
@@ -18,6 +21,28 @@ import (
 	"github.com/keybase/kbfs/tlf"
 )
 
+// mdStorageFileStripes is the number of stripes the MD and key bundle
+// file locks are split across. See the comment on
+// mdServerTlfStorage.fileStripes for why.
+const mdStorageFileStripes = 64
+
+// branchJournalState bundles one branch's on-disk mdIDJournal with
+// the RWMutex that serializes access to it. Giving each branch its
+// own lock means a slow put on one branch no longer blocks a
+// getRange or journalLength poll on an unrelated branch.
+type branchJournalState struct {
+	lock    sync.RWMutex
+	journal mdIDJournal
+
+	// compactedUpTo and compactionSnapshot record the bounds of the
+	// most recent Compact call on this branch, if any, so
+	// getRangeReadLocked can point a caller asking for an
+	// already-deleted revision at the snapshot that replaced it
+	// instead of just failing.
+	compactedUpTo      MetadataRevision
+	compactionSnapshot SnapshotID
+}
+
 // mdServerTlfStorage stores an ordered list of metadata IDs for each
 // branch of a single TLF, along with the associated metadata objects,
 // in flat files on disk.
@@ -60,23 +85,55 @@ import (
 // Writer (reader) key bundles for V3 metadata objects are stored
 // separately in dir/wkbv3 (dir/rkbv3). The number of bundles is
 // small, so no need to splay them.
+//
+// Locking is two-level. branchesLock is a short-lived, top-level
+// mutex that only guards branchJournals map mutation (creating or
+// deleting a branch's entry) and the shutdown flag; it is never held
+// during file IO or while waiting on any other lock. Each branch's
+// own journal is guarded by that branch's branchJournalState.lock, so
+// puts and gets on different branches never block each other. File
+// IO for MD objects and key bundles -- which can in principle be
+// shared data, read from any branch -- is further guarded by
+// fileStripes, keyed by (a hash of) the content ID, so puts of
+// unrelated IDs don't serialize behind each other even within the
+// same branch.
+//
+// The one operation that must touch two branches at once is put: it
+// always needs its own branch (to append to) plus NullBranchID (to
+// check permissions against the merged master head, and as a
+// fallback source of an unmerged branch's predecessor revision). To
+// avoid deadlocking against another put doing the same thing, or
+// against a get, every caller that locks more than one branch must
+// acquire them in ascending lexical order of BranchID.String(). See
+// rlockBranchesForGet and put's own locking below.
 type mdServerTlfStorage struct {
-	tlfID  tlf.ID
-	codec  kbfscodec.Codec
-	crypto cryptoPure
-	clock  Clock
-	mdVer  MetadataVer
-	dir    string
-
-	// Protects any IO operations in dir or any of its children,
-	// as well as branchJournals and its contents.
-	lock           sync.RWMutex
-	branchJournals map[BranchID]mdIDJournal
+	tlfID     tlf.ID
+	codec     kbfscodec.Codec
+	crypto    cryptoPure
+	clock     Clock
+	mdVer     MetadataVer
+	dir       string
+	mdJournal MDJournal
+	cipher    FileCipher
+
+	branchesLock   sync.RWMutex
+	branchJournals map[BranchID]*branchJournalState
+
+	fileStripes [mdStorageFileStripes]sync.RWMutex
 }
 
+// makeMDServerTlfStorage returns a new mdServerTlfStorage backed by
+// dir. If mdJournal is nil, a NilJournal is used, which matches the
+// pre-audit-journal behavior of recording nothing. If cipher is nil,
+// the serialized RMDS and key bundle files under dir are stored and
+// read back as plaintext, exactly as before FileCipher was
+// introduced.
 func makeMDServerTlfStorage(tlfID tlf.ID, codec kbfscodec.Codec,
 	crypto cryptoPure, clock Clock, mdVer MetadataVer,
-	dir string) *mdServerTlfStorage {
+	dir string, mdJournal MDJournal, cipher FileCipher) *mdServerTlfStorage {
+	if mdJournal == nil {
+		mdJournal = NilJournal{}
+	}
 	journal := &mdServerTlfStorage{
 		tlfID:          tlfID,
 		codec:          codec,
@@ -84,7 +141,9 @@ func makeMDServerTlfStorage(tlfID tlf.ID, codec kbfscodec.Codec,
 		clock:          clock,
 		mdVer:          mdVer,
 		dir:            dir,
-		branchJournals: make(map[BranchID]mdIDJournal),
+		mdJournal:      mdJournal,
+		cipher:         cipher,
+		branchJournals: make(map[BranchID]*branchJournalState),
 	}
 	return journal
 }
@@ -114,6 +173,15 @@ func (s *mdServerTlfStorage) mdPath(id MdID) string {
 	return filepath.Join(s.mdsPath(), idStr[:4], idStr[4:])
 }
 
+func (s *mdServerTlfStorage) snapshotsPath() string {
+	return filepath.Join(s.dir, "snapshots")
+}
+
+func (s *mdServerTlfStorage) snapshotPath(id SnapshotID) string {
+	idStr := id.String()
+	return filepath.Join(s.snapshotsPath(), idStr[:4], idStr[4:])
+}
+
 // serializedRMDS is the structure stored in mdPath(id).
 type serializedRMDS struct {
 	EncodedRMDS []byte
@@ -121,16 +189,82 @@ type serializedRMDS struct {
 	Version     MetadataVer
 }
 
-// getMDReadLocked verifies the MD data (but not the signature) for
-// the given ID and returns it.
+// fileStripe returns the lock that guards file IO for the given
+// content-addressed key (an MdID, TLFWriterKeyBundleID, or
+// TLFReaderKeyBundleID, each by its String() form).
+func (s *mdServerTlfStorage) fileStripe(key string) *sync.RWMutex {
+	h := fnv.New32a()
+	_, _ = io.WriteString(h, key)
+	return &s.fileStripes[h.Sum32()%mdStorageFileStripes]
+}
+
+// sortedStripeIndices returns the distinct stripe indices covering
+// keys, in ascending order, so that callers locking more than one
+// stripe at a time can agree on a single lock order and avoid
+// deadlocking against each other.
+func sortedStripeIndices(keys ...string) []uint32 {
+	indices := make(map[uint32]bool, len(keys))
+	for _, key := range keys {
+		h := fnv.New32a()
+		_, _ = io.WriteString(h, key)
+		indices[h.Sum32()%mdStorageFileStripes] = true
+	}
+
+	sorted := make([]uint32, 0, len(indices))
+	for idx := range indices {
+		sorted = append(sorted, idx)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+// lockFileStripesForWrite locks, in ascending index order to avoid
+// deadlocking against another multi-key write, the distinct stripes
+// covering keys, and returns a function to unlock them all.
+func (s *mdServerTlfStorage) lockFileStripesForWrite(
+	keys ...string) (unlock func()) {
+	sorted := sortedStripeIndices(keys...)
+
+	for _, idx := range sorted {
+		s.fileStripes[idx].Lock()
+	}
+	return func() {
+		for i := len(sorted) - 1; i >= 0; i-- {
+			s.fileStripes[sorted[i]].Unlock()
+		}
+	}
+}
+
+// lockFileStripesForRead RLocks, in the same ascending index order
+// lockFileStripesForWrite uses, the distinct stripes covering keys,
+// and returns a function to unlock them all. Callers that read more
+// than one stripe at a time must use this instead of locking each
+// stripe individually, so their lock order agrees with
+// lockFileStripesForWrite's.
+func (s *mdServerTlfStorage) lockFileStripesForRead(
+	keys ...string) (unlock func()) {
+	sorted := sortedStripeIndices(keys...)
+
+	for _, idx := range sorted {
+		s.fileStripes[idx].RLock()
+	}
+	return func() {
+		for i := len(sorted) - 1; i >= 0; i-- {
+			s.fileStripes[sorted[i]].RUnlock()
+		}
+	}
+}
+
+// getMDLocked reads and verifies the MD data (but not the signature)
+// for the given ID. The caller must already hold at least a read
+// lock on s.fileStripe(id.String()).
 //
 // TODO: Verify signature?
-func (s *mdServerTlfStorage) getMDReadLocked(id MdID) (
+func (s *mdServerTlfStorage) getMDLocked(id MdID) (
 	*RootMetadataSigned, error) {
-	// Read file.
-
 	var srmds serializedRMDS
-	err := kbfscodec.DeserializeFromFile(s.codec, s.mdPath(id), &srmds)
+	err := deserializeFromFileMaybeEncrypted(
+		s.codec, s.cipher, s.tlfID, s.mdPath(id), &srmds)
 	if err != nil {
 		return nil, err
 	}
@@ -158,14 +292,28 @@ func (s *mdServerTlfStorage) getMDReadLocked(id MdID) (
 	return rmds, nil
 }
 
-func (s *mdServerTlfStorage) putMDLocked(
-	rmds *RootMetadataSigned) (MdID, error) {
+// getMD is getMDLocked for callers that don't already hold the
+// relevant file stripe lock.
+func (s *mdServerTlfStorage) getMD(id MdID) (*RootMetadataSigned, error) {
+	stripe := s.fileStripe(id.String())
+	stripe.RLock()
+	defer stripe.RUnlock()
+	return s.getMDLocked(id)
+}
+
+// putMD computes rmds's MdID, and writes it to disk under its own
+// file stripe lock if it isn't there already.
+func (s *mdServerTlfStorage) putMD(rmds *RootMetadataSigned) (MdID, error) {
 	id, err := s.crypto.MakeMdID(rmds.MD)
 	if err != nil {
 		return MdID{}, err
 	}
 
-	_, err = s.getMDReadLocked(id)
+	stripe := s.fileStripe(id.String())
+	stripe.Lock()
+	defer stripe.Unlock()
+
+	_, err = s.getMDLocked(id)
 	if os.IsNotExist(err) {
 		// Continue on.
 	} else if err != nil {
@@ -186,7 +334,8 @@ func (s *mdServerTlfStorage) putMDLocked(
 		Version:     rmds.MD.Version(),
 	}
 
-	err = kbfscodec.SerializeToFile(s.codec, srmds, s.mdPath(id))
+	err = serializeToFileMaybeEncrypted(
+		s.codec, s.cipher, s.tlfID, srmds, s.mdPath(id))
 	if err != nil {
 		return MdID{}, err
 	}
@@ -194,59 +343,123 @@ func (s *mdServerTlfStorage) putMDLocked(
 	return id, nil
 }
 
-func (s *mdServerTlfStorage) getOrCreateBranchJournalLocked(
-	bid BranchID) (mdIDJournal, error) {
-	j, ok := s.branchJournals[bid]
-	if ok {
-		return j, nil
+// getBranchState returns the branch's state, or nil if nothing has
+// ever been put to it.
+func (s *mdServerTlfStorage) getBranchState(bid BranchID) *branchJournalState {
+	s.branchesLock.RLock()
+	defer s.branchesLock.RUnlock()
+	return s.branchJournals[bid]
+}
+
+// getOrCreateBranchState returns the branch's state, creating its
+// on-disk journal directory and in-memory entry first if necessary.
+func (s *mdServerTlfStorage) getOrCreateBranchState(
+	bid BranchID) (*branchJournalState, error) {
+	if bs := s.getBranchState(bid); bs != nil {
+		return bs, nil
+	}
+
+	s.branchesLock.Lock()
+	defer s.branchesLock.Unlock()
+
+	if s.branchJournals == nil {
+		return nil, errMDServerTlfStorageShutdown
+	}
+
+	if bs, ok := s.branchJournals[bid]; ok {
+		return bs, nil
 	}
 
 	dir := filepath.Join(s.branchJournalsPath(), bid.String())
 	err := os.MkdirAll(dir, 0700)
 	if err != nil {
-		return mdIDJournal{}, err
+		return nil, err
+	}
+
+	bs := &branchJournalState{journal: makeMdIDJournal(s.codec, dir)}
+	s.branchJournals[bid] = bs
+	return bs, nil
+}
+
+// rlockBranchesForGet read-locks the branch states needed to serve a
+// get against bid -- bid itself, plus NullBranchID for the
+// merged-master permission check in checkGetParamsReadLocked -- in
+// ascending lexical order of BranchID.String(). Locking in the same
+// order put uses for its write lock means a concurrent get can never
+// deadlock against a concurrent put. A branch with no on-disk state
+// yet simply contributes no lock.
+func (s *mdServerTlfStorage) rlockBranchesForGet(bid BranchID) (unlock func()) {
+	ids := []BranchID{bid}
+	if bid != NullBranchID {
+		ids = append(ids, NullBranchID)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].String() < ids[j].String()
+	})
+
+	var locked []*branchJournalState
+	for _, id := range ids {
+		bs := s.getBranchState(id)
+		if bs == nil {
+			continue
+		}
+		bs.lock.RLock()
+		locked = append(locked, bs)
 	}
 
-	j = makeMdIDJournal(s.codec, dir)
-	s.branchJournals[bid] = j
-	return j, nil
+	return func() {
+		for i := len(locked) - 1; i >= 0; i-- {
+			locked[i].lock.RUnlock()
+		}
+	}
 }
 
+// getHeadForTLFReadLocked returns bid's head. The caller must already
+// hold at least a read lock on bid's branchJournalState (if it
+// exists).
 func (s *mdServerTlfStorage) getHeadForTLFReadLocked(bid BranchID) (
 	rmds *RootMetadataSigned, err error) {
-	j, ok := s.branchJournals[bid]
-	if !ok {
+	bs := s.getBranchState(bid)
+	if bs == nil {
 		return nil, nil
 	}
-	entry, exists, err := j.getLatestEntry()
+	entry, exists, err := bs.journal.getLatestEntry()
 	if err != nil {
 		return nil, err
 	}
 	if !exists {
 		return nil, nil
 	}
-	return s.getMDReadLocked(entry.ID)
+	return s.getMD(entry.ID)
 }
 
+// checkGetParamsReadLocked checks that currentUID is allowed to read
+// bid. The caller must already hold at least a read lock on bid's and
+// NullBranchID's branchJournalState (e.g. via rlockBranchesForGet).
 func (s *mdServerTlfStorage) checkGetParamsReadLocked(
 	currentUID keybase1.UID, bid BranchID) error {
 	mergedMasterHead, err := s.getHeadForTLFReadLocked(NullBranchID)
 	if err != nil {
+		s.mdJournal.RecordReject("get merged master head failed", err)
 		return MDServerError{err}
 	}
 
 	if mergedMasterHead != nil {
-		extra, err := s.getExtraMetadataReadLocked(
+		extra, err := s.getExtraMetadata(
 			mergedMasterHead.MD.GetTLFWriterKeyBundleID(),
 			mergedMasterHead.MD.GetTLFReaderKeyBundleID())
 		if err != nil {
+			s.mdJournal.RecordReject("get extra metadata failed", err)
 			return MDServerError{err}
 		}
 		ok, err := isReader(currentUID, mergedMasterHead.MD, extra)
 		if err != nil {
+			s.mdJournal.RecordReject("reader check failed", err)
 			return MDServerError{err}
 		}
 		if !ok {
+			s.mdJournal.RecordReject(
+				"unauthorized reader", MDServerErrorUnauthorized{})
 			return MDServerErrorUnauthorized{}
 		}
 	}
@@ -254,6 +467,24 @@ func (s *mdServerTlfStorage) checkGetParamsReadLocked(
 	return nil
 }
 
+// ErrRevisionCompacted is returned by getRangeReadLocked (and so by
+// getRange) when start asks for a revision on bid that Compact has
+// already deleted. FirstAvailable is the oldest revision still on
+// disk for that branch; Snapshot identifies the blob a caller can
+// fetch instead to recover a summary of the deleted history.
+type ErrRevisionCompacted struct {
+	FirstAvailable MetadataRevision
+	Snapshot       SnapshotID
+}
+
+// Error implements the error interface for ErrRevisionCompacted.
+func (e ErrRevisionCompacted) Error() string {
+	return fmt.Sprintf(
+		"mdserver: revisions before %d have been compacted; see snapshot %s",
+		e.FirstAvailable, e.Snapshot)
+}
+
+// getRangeReadLocked requires the same locks as checkGetParamsReadLocked.
 func (s *mdServerTlfStorage) getRangeReadLocked(
 	currentUID keybase1.UID, bid BranchID, start, stop MetadataRevision) (
 	[]*RootMetadataSigned, error) {
@@ -262,19 +493,26 @@ func (s *mdServerTlfStorage) getRangeReadLocked(
 		return nil, err
 	}
 
-	j, ok := s.branchJournals[bid]
-	if !ok {
+	bs := s.getBranchState(bid)
+	if bs == nil {
 		return nil, nil
 	}
 
-	realStart, entries, err := j.getEntryRange(start, stop)
+	if bs.compactedUpTo > 0 && start < bs.compactedUpTo {
+		return nil, ErrRevisionCompacted{
+			FirstAvailable: bs.compactedUpTo,
+			Snapshot:       bs.compactionSnapshot,
+		}
+	}
+
+	realStart, entries, err := bs.journal.getEntryRange(start, stop)
 	if err != nil {
 		return nil, err
 	}
 	var rmdses []*RootMetadataSigned
 	for i, entry := range entries {
 		expectedRevision := realStart + MetadataRevision(i)
-		rmds, err := s.getMDReadLocked(entry.ID)
+		rmds, err := s.getMD(entry.ID)
 		if err != nil {
 			return nil, MDServerError{err}
 		}
@@ -288,10 +526,10 @@ func (s *mdServerTlfStorage) getRangeReadLocked(
 	return rmdses, nil
 }
 
-func (s *mdServerTlfStorage) getExtraMetadataReadLocked(
+func (s *mdServerTlfStorage) getExtraMetadata(
 	wkbID TLFWriterKeyBundleID, rkbID TLFReaderKeyBundleID) (
 	ExtraMetadata, error) {
-	wkb, rkb, err := s.getKeyBundlesReadLocked(wkbID, rkbID)
+	wkb, rkb, err := s.getKeyBundles(wkbID, rkbID)
 	if err != nil {
 		return nil, err
 	}
@@ -301,7 +539,7 @@ func (s *mdServerTlfStorage) getExtraMetadataReadLocked(
 	return &ExtraMetadataV3{wkb: wkb, rkb: rkb}, nil
 }
 
-func (s *mdServerTlfStorage) getKeyBundlesReadLocked(
+func (s *mdServerTlfStorage) getKeyBundles(
 	wkbID TLFWriterKeyBundleID, rkbID TLFReaderKeyBundleID) (
 	*TLFWriterKeyBundleV3, *TLFReaderKeyBundleV3, error) {
 	if (wkbID == TLFWriterKeyBundleID{}) !=
@@ -316,16 +554,19 @@ func (s *mdServerTlfStorage) getKeyBundlesReadLocked(
 		return nil, nil, nil
 	}
 
+	unlock := s.lockFileStripesForRead(wkbID.String(), rkbID.String())
+	defer unlock()
+
 	var wkb TLFWriterKeyBundleV3
-	err := kbfscodec.DeserializeFromFile(
-		s.codec, s.writerKeyBundleV3Path(wkbID), &wkb)
+	err := deserializeFromFileMaybeEncrypted(
+		s.codec, s.cipher, s.tlfID, s.writerKeyBundleV3Path(wkbID), &wkb)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	var rkb TLFReaderKeyBundleV3
-	err = kbfscodec.DeserializeFromFile(
-		s.codec, s.readerKeyBundleV3Path(rkbID), &rkb)
+	err = deserializeFromFileMaybeEncrypted(
+		s.codec, s.cipher, s.tlfID, s.readerKeyBundleV3Path(rkbID), &rkb)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -365,7 +606,9 @@ func checkKeyBundlesV3(
 	return nil
 }
 
-func (s *mdServerTlfStorage) putExtraMetadataLocked(
+// putExtraMetadata writes extra's key bundles to disk under their own
+// file stripe locks.
+func (s *mdServerTlfStorage) putExtraMetadata(
 	rmds *RootMetadataSigned, extra ExtraMetadata) error {
 	if extra == nil {
 		return nil
@@ -383,31 +626,41 @@ func (s *mdServerTlfStorage) putExtraMetadataLocked(
 
 	extraV3, ok := extra.(*ExtraMetadataV3)
 	if !ok {
-		return errors.New("Invalid extra metadata")
+		err := errors.New("Invalid extra metadata")
+		s.mdJournal.RecordReject("invalid extra metadata", err)
+		return err
 	}
 
 	err := checkKeyBundlesV3(
 		s.crypto, wkbID, rkbID, extraV3.wkb, extraV3.rkb)
 	if err != nil {
+		s.mdJournal.RecordReject("key bundle ID mismatch", err)
 		return err
 	}
 
-	err = kbfscodec.SerializeToFile(
-		s.codec, extraV3.wkb, s.writerKeyBundleV3Path(wkbID))
+	unlock := s.lockFileStripesForWrite(wkbID.String(), rkbID.String())
+	defer unlock()
+
+	err = serializeToFileMaybeEncrypted(
+		s.codec, s.cipher, s.tlfID, extraV3.wkb, s.writerKeyBundleV3Path(wkbID))
 	if err != nil {
+		s.mdJournal.RecordReject("writer key bundle write failed", err)
 		return err
 	}
 
-	err = kbfscodec.SerializeToFile(
-		s.codec, extraV3.rkb, s.readerKeyBundleV3Path(rkbID))
+	err = serializeToFileMaybeEncrypted(
+		s.codec, s.cipher, s.tlfID, extraV3.rkb, s.readerKeyBundleV3Path(rkbID))
 	if err != nil {
+		s.mdJournal.RecordReject("reader key bundle write failed", err)
 		return err
 	}
 
 	return nil
 }
 
-func (s *mdServerTlfStorage) isShutdownReadLocked() bool {
+func (s *mdServerTlfStorage) isShutdown() bool {
+	s.branchesLock.RLock()
+	defer s.branchesLock.RUnlock()
 	return s.branchJournals == nil
 }
 
@@ -416,30 +669,29 @@ func (s *mdServerTlfStorage) isShutdownReadLocked() bool {
 var errMDServerTlfStorageShutdown = errors.New("mdServerTlfStorage is shutdown")
 
 func (s *mdServerTlfStorage) journalLength(bid BranchID) (uint64, error) {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-
-	if s.isShutdownReadLocked() {
+	if s.isShutdown() {
 		return 0, errMDServerTlfStorageShutdown
 	}
 
-	j, ok := s.branchJournals[bid]
-	if !ok {
+	bs := s.getBranchState(bid)
+	if bs == nil {
 		return 0, nil
 	}
 
-	return j.length()
+	bs.lock.RLock()
+	defer bs.lock.RUnlock()
+	return bs.journal.length()
 }
 
 func (s *mdServerTlfStorage) getForTLF(
 	currentUID keybase1.UID, bid BranchID) (*RootMetadataSigned, error) {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-
-	if s.isShutdownReadLocked() {
+	if s.isShutdown() {
 		return nil, errMDServerTlfStorageShutdown
 	}
 
+	unlock := s.rlockBranchesForGet(bid)
+	defer unlock()
+
 	err := s.checkGetParamsReadLocked(currentUID, bid)
 	if err != nil {
 		return nil, err
@@ -449,19 +701,26 @@ func (s *mdServerTlfStorage) getForTLF(
 	if err != nil {
 		return nil, MDServerError{err}
 	}
+	if rmds != nil {
+		mdID, err := s.crypto.MakeMdID(rmds.MD)
+		if err == nil {
+			s.mdJournal.RecordGet(s.tlfID, bid, rmds.MD.RevisionNumber(),
+				mdID, currentUID, s.clock.Now())
+		}
+	}
 	return rmds, nil
 }
 
 func (s *mdServerTlfStorage) getRange(
 	currentUID keybase1.UID, bid BranchID, start, stop MetadataRevision) (
 	[]*RootMetadataSigned, error) {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-
-	if s.isShutdownReadLocked() {
+	if s.isShutdown() {
 		return nil, errMDServerTlfStorageShutdown
 	}
 
+	unlock := s.rlockBranchesForGet(bid)
+	defer unlock()
+
 	return s.getRangeReadLocked(currentUID, bid, start, stop)
 }
 
@@ -469,30 +728,64 @@ func (s *mdServerTlfStorage) put(
 	currentUID keybase1.UID, currentVerifyingKey kbfscrypto.VerifyingKey,
 	rmds *RootMetadataSigned, extra ExtraMetadata) (
 	recordBranchID bool, err error) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-
-	if s.isShutdownReadLocked() {
+	if s.isShutdown() {
 		return false, errMDServerTlfStorageShutdown
 	}
 
+	bid := rmds.MD.BID()
+
+	branchBS, err := s.getOrCreateBranchState(bid)
+	if err != nil {
+		s.mdJournal.RecordReject("creating branch state failed", err)
+		return false, err
+	}
+
+	masterBS := branchBS
+	if bid != NullBranchID {
+		masterBS, err = s.getOrCreateBranchState(NullBranchID)
+		if err != nil {
+			s.mdJournal.RecordReject("creating master branch state failed", err)
+			return false, err
+		}
+	}
+
+	// Lock ordering: see the package comment on mdServerTlfStorage.
+	// A put on NullBranchID only ever needs the one lock.
+	if bid == NullBranchID {
+		branchBS.lock.Lock()
+		defer branchBS.lock.Unlock()
+	} else if bid.String() < NullBranchID.String() {
+		branchBS.lock.Lock()
+		defer branchBS.lock.Unlock()
+		masterBS.lock.RLock()
+		defer masterBS.lock.RUnlock()
+	} else {
+		masterBS.lock.RLock()
+		defer masterBS.lock.RUnlock()
+		branchBS.lock.Lock()
+		defer branchBS.lock.Unlock()
+	}
+
 	if extra == nil {
 		var err error
-		extra, err = s.getExtraMetadataReadLocked(
+		extra, err = s.getExtraMetadata(
 			rmds.MD.GetTLFWriterKeyBundleID(),
 			rmds.MD.GetTLFReaderKeyBundleID())
 		if err != nil {
+			s.mdJournal.RecordReject("getting extra metadata failed", err)
 			return false, MDServerError{err}
 		}
 	}
 
 	err = rmds.IsValidAndSigned(s.codec, s.crypto, extra)
 	if err != nil {
+		s.mdJournal.RecordReject("invalid or unsigned MD", err)
 		return false, MDServerErrorBadRequest{Reason: err.Error()}
 	}
 
 	err = rmds.IsLastModifiedBy(currentUID, currentVerifyingKey)
 	if err != nil {
+		s.mdJournal.RecordReject("last-modified-by check failed", err)
 		return false, MDServerErrorBadRequest{Reason: err.Error()}
 	}
 
@@ -500,15 +793,18 @@ func (s *mdServerTlfStorage) put(
 
 	mergedMasterHead, err := s.getHeadForTLFReadLocked(NullBranchID)
 	if err != nil {
+		s.mdJournal.RecordReject("getting merged master head failed", err)
 		return false, MDServerError{err}
 	}
 
 	// TODO: Figure out nil case.
 	if mergedMasterHead != nil {
-		prevExtra, err := s.getExtraMetadataReadLocked(
+		prevExtra, err := s.getExtraMetadata(
 			mergedMasterHead.MD.GetTLFWriterKeyBundleID(),
 			mergedMasterHead.MD.GetTLFReaderKeyBundleID())
 		if err != nil {
+			s.mdJournal.RecordReject(
+				"getting previous extra metadata failed", err)
 			return false, MDServerError{err}
 		}
 		ok, err := isWriterOrValidRekey(
@@ -516,18 +812,21 @@ func (s *mdServerTlfStorage) put(
 			mergedMasterHead.MD, rmds.MD,
 			prevExtra, extra)
 		if err != nil {
+			s.mdJournal.RecordReject("writer or rekey check failed", err)
 			return false, MDServerError{err}
 		}
 		if !ok {
+			s.mdJournal.RecordReject(
+				"unauthorized writer or rekey", MDServerErrorUnauthorized{})
 			return false, MDServerErrorUnauthorized{}
 		}
 	}
 
-	bid := rmds.MD.BID()
 	mStatus := rmds.MD.MergedStatus()
 
 	head, err := s.getHeadForTLFReadLocked(bid)
 	if err != nil {
+		s.mdJournal.RecordReject("getting branch head failed", err)
 		return false, MDServerError{err}
 	}
 
@@ -537,12 +836,15 @@ func (s *mdServerTlfStorage) put(
 		rmdses, err := s.getRangeReadLocked(
 			currentUID, NullBranchID, prevRev, prevRev)
 		if err != nil {
+			s.mdJournal.RecordReject(
+				"getting previous revision for new branch failed", err)
 			return false, MDServerError{err}
 		}
 		if len(rmdses) != 1 {
-			return false, MDServerError{
-				Err: fmt.Errorf("Expected 1 MD block got %d", len(rmdses)),
-			}
+			err := fmt.Errorf("Expected 1 MD block got %d", len(rmdses))
+			s.mdJournal.RecordReject(
+				"previous revision for new branch not found", err)
+			return false, MDServerError{Err: err}
 		}
 		head = rmdses[0]
 		recordBranchID = true
@@ -552,48 +854,47 @@ func (s *mdServerTlfStorage) put(
 	if head != nil {
 		headID, err := s.crypto.MakeMdID(head.MD)
 		if err != nil {
+			s.mdJournal.RecordReject("hashing branch head failed", err)
 			return false, MDServerError{err}
 		}
 
 		err = head.MD.CheckValidSuccessorForServer(headID, rmds.MD)
 		if err != nil {
+			s.mdJournal.RecordReject("invalid successor", err)
 			return false, err
 		}
 	}
 
-	id, err := s.putMDLocked(rmds)
+	id, err := s.putMD(rmds)
 	if err != nil {
+		s.mdJournal.RecordReject("writing MD to disk failed", err)
 		return false, MDServerError{err}
 	}
 
-	err = s.putExtraMetadataLocked(rmds, extra)
+	err = s.putExtraMetadata(rmds, extra)
 	if err != nil {
+		s.mdJournal.RecordReject("writing extra metadata to disk failed", err)
 		return false, MDServerError{err}
 	}
 
-	j, err := s.getOrCreateBranchJournalLocked(bid)
-	if err != nil {
-		return false, err
-	}
-
-	err = j.append(rmds.MD.RevisionNumber(), mdIDJournalEntry{ID: id})
+	err = branchBS.journal.append(rmds.MD.RevisionNumber(), mdIDJournalEntry{ID: id})
 	if err != nil {
+		s.mdJournal.RecordReject("appending to branch journal failed", err)
 		return false, MDServerError{err}
 	}
 
-	return recordBranchID, nil
-}
+	s.mdJournal.RecordPut(
+		s.tlfID, bid, rmds.MD.RevisionNumber(), id, currentUID, s.clock.Now())
 
-func (s *mdServerTlfStorage) getKeyBundles(
-	wkbID TLFWriterKeyBundleID, rkbID TLFReaderKeyBundleID) (
-	*TLFWriterKeyBundleV3, *TLFReaderKeyBundleV3, error) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	return s.getKeyBundlesReadLocked(wkbID, rkbID)
+	return recordBranchID, nil
 }
 
 func (s *mdServerTlfStorage) shutdown() {
-	s.lock.Lock()
-	defer s.lock.Unlock()
+	s.branchesLock.Lock()
 	s.branchJournals = nil
+	s.branchesLock.Unlock()
+
+	// Best-effort; there's nowhere left to report a close failure to
+	// once the journal itself is what failed to close.
+	_ = s.mdJournal.Close()
 }
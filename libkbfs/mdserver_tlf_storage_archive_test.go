@@ -0,0 +1,162 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+// TestArchiveBlockRoundTrip writes a handful of blocks of varying
+// kind, key, and payload size (including an empty payload) to a
+// buffer and checks that readArchiveBlock reads each one back
+// unchanged, in order, before hitting EOF.
+func TestArchiveBlockRoundTrip(t *testing.T) {
+	blocks := []struct {
+		kind    archiveBlockKind
+		key     []byte
+		payload []byte
+	}{
+		{archiveMDBlock, []byte("mdkey"), []byte("some RMDS bytes")},
+		{archiveWKBBlock, []byte("wkbkey"), nil},
+		{archiveRKBBlock, []byte{}, []byte("rkb payload")},
+		{archiveJournalFileBlock, []byte("journalkey"), bytes.Repeat([]byte{0xff}, 4096)},
+	}
+
+	var buf bytes.Buffer
+	for _, b := range blocks {
+		_, err := writeArchiveBlock(&buf, b.kind, b.key, b.payload)
+		require.NoError(t, err)
+	}
+
+	for _, want := range blocks {
+		kind, key, payload, err := readArchiveBlock(&buf)
+		require.NoError(t, err)
+		require.Equal(t, want.kind, kind)
+		require.Equal(t, want.key, key)
+		require.Equal(t, want.payload, payload)
+	}
+
+	_, _, _, err := readArchiveBlock(&buf)
+	require.Equal(t, io.EOF, err)
+}
+
+// TestDecryptArchivePayload checks that decryptArchivePayload reverses
+// an AESGCMFileCipher encryption bound to the same (tlfID, basename),
+// and passes payload through unchanged when no cipher is configured.
+func TestDecryptArchivePayload(t *testing.T) {
+	var key [32]byte
+	key[0] = 1
+	cipher, err := NewAESGCMFileCipher(key)
+	require.NoError(t, err)
+
+	tlfID := tlf.FakeID(1, tlf.Private)
+	plaintext := []byte("serialized MD block")
+	basename := "deadbeef"
+
+	ciphertext, err := cipher.Encrypt(tlfID, basename, plaintext)
+	require.NoError(t, err)
+
+	s := &mdServerTlfStorage{tlfID: tlfID, cipher: cipher}
+	decoded, err := decryptArchivePayload(s, basename, ciphertext)
+	require.NoError(t, err)
+	require.Equal(t, plaintext, decoded)
+
+	s.cipher = nil
+	decoded, err = decryptArchivePayload(s, basename, plaintext)
+	require.NoError(t, err)
+	require.Equal(t, plaintext, decoded)
+}
+
+// TestStageContentAddressedBlock checks that a block whose payload
+// disagrees with what's already on disk at finalPath is rejected, and
+// that one matching (or not yet present) is staged under tmpDir.
+func TestStageContentAddressedBlock(t *testing.T) {
+	finalDir, err := ioutil.TempDir("", "mdserver_tlf_storage_archive_test_final")
+	require.NoError(t, err)
+	defer os.RemoveAll(finalDir)
+
+	tmpDir, err := ioutil.TempDir("", "mdserver_tlf_storage_archive_test_tmp")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	finalPath := filepath.Join(finalDir, "mds", "dead", "beef")
+
+	s := &mdServerTlfStorage{dir: finalDir, tlfID: tlf.FakeID(1, tlf.Private)}
+	noopVerify := func() error { return nil }
+
+	// Not yet present on disk: stages cleanly.
+	err = stageContentAddressedBlock(
+		s, tmpDir, finalPath, []byte("payload"), noopVerify)
+	require.NoError(t, err)
+	staged, err := ioutil.ReadFile(filepath.Join(tmpDir, "mds", "dead", "beef"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("payload"), staged)
+
+	// Write the same content into finalPath, as if a previous import
+	// had already completed; staging it again must still succeed.
+	require.NoError(t, os.MkdirAll(filepath.Dir(finalPath), 0700))
+	require.NoError(t, ioutil.WriteFile(finalPath, []byte("payload"), 0600))
+	err = stageContentAddressedBlock(
+		s, tmpDir, finalPath, []byte("payload"), noopVerify)
+	require.NoError(t, err)
+
+	// Different content at the same content-addressed path is a
+	// collision and must be rejected.
+	err = stageContentAddressedBlock(
+		s, tmpDir, finalPath, []byte("other payload"), noopVerify)
+	require.Error(t, err)
+}
+
+// TestStageContentAddressedBlockEncrypted checks that the collision
+// check in stageContentAddressedBlock compares decrypted plaintext,
+// not raw ciphertext, so re-staging identical plaintext that happens
+// to have been sealed with a different nonce isn't mistaken for a
+// collision.
+func TestStageContentAddressedBlockEncrypted(t *testing.T) {
+	finalDir, err := ioutil.TempDir("", "mdserver_tlf_storage_archive_test_final")
+	require.NoError(t, err)
+	defer os.RemoveAll(finalDir)
+
+	tmpDir, err := ioutil.TempDir("", "mdserver_tlf_storage_archive_test_tmp")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	var key [32]byte
+	key[0] = 1
+	cipher, err := NewAESGCMFileCipher(key)
+	require.NoError(t, err)
+
+	tlfID := tlf.FakeID(1, tlf.Private)
+	s := &mdServerTlfStorage{dir: finalDir, tlfID: tlfID, cipher: cipher}
+
+	finalPath := filepath.Join(finalDir, "mds", "dead", "beef")
+	require.NoError(t, os.MkdirAll(filepath.Dir(finalPath), 0700))
+
+	plaintext := []byte("identical plaintext content")
+	basename := filepath.Base(finalPath)
+
+	// Seal the same plaintext twice; AES-GCM's random nonce means the
+	// two ciphertexts differ even though the plaintext doesn't.
+	existingCiphertext, err := cipher.Encrypt(tlfID, basename, plaintext)
+	require.NoError(t, err)
+	incomingCiphertext, err := cipher.Encrypt(tlfID, basename, plaintext)
+	require.NoError(t, err)
+	require.NotEqual(t, existingCiphertext, incomingCiphertext)
+
+	require.NoError(t, ioutil.WriteFile(finalPath, existingCiphertext, 0600))
+
+	noopVerify := func() error { return nil }
+	err = stageContentAddressedBlock(
+		s, tmpDir, finalPath, incomingCiphertext, noopVerify)
+	require.NoError(t, err)
+}
@@ -0,0 +1,262 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/tlf"
+)
+
+// FileCipher encrypts and decrypts the raw bytes of a single on-disk
+// state file. It is the at-rest encryption hook for
+// mdServerTlfStorage: when set, dir/mds, dir/wkbv3, dir/rkbv3, and
+// dir/snapshots hold ciphertext instead of plaintext codec blobs.
+//
+// Implementations must bind the ciphertext to both tlfID and
+// basename (e.g. as AEAD associated data), so that a file can't be
+// copied or renamed into a different TLF's directory, or into a
+// different slot of the same directory (say from wkbv3 to rkbv3),
+// and still decrypt successfully.
+type FileCipher interface {
+	Encrypt(tlfID tlf.ID, basename string, plaintext []byte) ([]byte, error)
+	Decrypt(tlfID tlf.ID, basename string, ciphertext []byte) ([]byte, error)
+}
+
+const (
+	fileCipherMagic     = "KBFE"
+	fileCipherVersion   = 1
+	fileCipherNonceSize = 12
+	fileCipherHeaderLen = len(fileCipherMagic) + 1 + fileCipherNonceSize
+)
+
+var errFileCipherTruncated = errors.New(
+	"mdserver: encrypted file is too short to contain a header")
+
+// AESGCMFileCipher is a FileCipher that encrypts every file with a
+// single AES-256-GCM key derived via HKDF-SHA256 from a device-scoped
+// master key, using a fresh random nonce per file.
+type AESGCMFileCipher struct {
+	aead cipher.AEAD
+}
+
+// NewAESGCMFileCipher derives an AES-256 key from masterKey via
+// HKDF-SHA256 and returns a FileCipher backed by it.
+func NewAESGCMFileCipher(masterKey [32]byte) (*AESGCMFileCipher, error) {
+	keyReader := hkdf.New(
+		sha256.New, masterKey[:], nil,
+		[]byte("KBFS mdServerTlfStorage at-rest file encryption"))
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(keyReader, key); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AESGCMFileCipher{aead: aead}, nil
+}
+
+func fileCipherAAD(tlfID tlf.ID, basename string) []byte {
+	aad := make([]byte, 0, len(basename)+len(tlfID.String())+1)
+	aad = append(aad, []byte(basename)...)
+	aad = append(aad, ':')
+	aad = append(aad, []byte(tlfID.String())...)
+	return aad
+}
+
+// Encrypt implements the FileCipher interface for AESGCMFileCipher.
+// The returned blob is {magic, version, nonce} followed by the
+// AES-GCM sealed ciphertext.
+func (c *AESGCMFileCipher) Encrypt(
+	tlfID tlf.ID, basename string, plaintext []byte) ([]byte, error) {
+	var nonce [fileCipherNonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+
+	sealed := c.aead.Seal(
+		nil, nonce[:], plaintext, fileCipherAAD(tlfID, basename))
+
+	blob := make([]byte, 0, fileCipherHeaderLen+len(sealed))
+	blob = append(blob, []byte(fileCipherMagic)...)
+	blob = append(blob, byte(fileCipherVersion))
+	blob = append(blob, nonce[:]...)
+	blob = append(blob, sealed...)
+	return blob, nil
+}
+
+// Decrypt implements the FileCipher interface for AESGCMFileCipher.
+func (c *AESGCMFileCipher) Decrypt(
+	tlfID tlf.ID, basename string, blob []byte) ([]byte, error) {
+	if len(blob) < fileCipherHeaderLen {
+		return nil, errFileCipherTruncated
+	}
+
+	magic := string(blob[:len(fileCipherMagic)])
+	if magic != fileCipherMagic {
+		return nil, fmt.Errorf("mdserver: bad encrypted file magic %q", magic)
+	}
+
+	version := blob[len(fileCipherMagic)]
+	if version != fileCipherVersion {
+		return nil, fmt.Errorf(
+			"mdserver: unsupported encrypted file version %d", version)
+	}
+
+	nonce := blob[len(fileCipherMagic)+1 : fileCipherHeaderLen]
+	sealed := blob[fileCipherHeaderLen:]
+	return c.aead.Open(nil, nonce, sealed, fileCipherAAD(tlfID, basename))
+}
+
+// serializeToFileMaybeEncrypted codec-encodes obj and writes it to
+// path, atomically. If cipher is non-nil, the encoded bytes are
+// encrypted first, bound to tlfID and path's basename. If cipher is
+// nil, this is equivalent to kbfscodec.SerializeToFile.
+func serializeToFileMaybeEncrypted(
+	codec kbfscodec.Codec, cipher FileCipher, tlfID tlf.ID,
+	obj interface{}, path string) error {
+	if cipher == nil {
+		return kbfscodec.SerializeToFile(codec, obj, path)
+	}
+
+	encoded, err := codec.Encode(obj)
+	if err != nil {
+		return err
+	}
+
+	blob, err := cipher.Encrypt(tlfID, filepath.Base(path), encoded)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, blob)
+}
+
+// deserializeFromFileMaybeEncrypted is the inverse of
+// serializeToFileMaybeEncrypted. If cipher is nil, this is equivalent
+// to kbfscodec.DeserializeFromFile.
+func deserializeFromFileMaybeEncrypted(
+	codec kbfscodec.Codec, cipher FileCipher, tlfID tlf.ID,
+	path string, obj interface{}) error {
+	if cipher == nil {
+		return kbfscodec.DeserializeFromFile(codec, path, obj)
+	}
+
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	encoded, err := cipher.Decrypt(tlfID, filepath.Base(path), blob)
+	if err != nil {
+		return err
+	}
+
+	return codec.Decode(encoded, obj)
+}
+
+// writeFileAtomic writes data to path by writing it to a temporary
+// file in the same directory and renaming it into place, so a reader
+// never observes a partially-written file.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	return os.Rename(tmpName, path)
+}
+
+// migrateTransform rewrites every regular file under dir/mds,
+// dir/wkbv3, dir/rkbv3, and dir/snapshots by passing its raw bytes
+// through transform, leaving the rest of the directory (branch
+// journals) untouched.
+func migrateTransform(
+	dir string, transform func(basename string, data []byte) ([]byte, error)) error {
+	for _, sub := range []string{"mds", "wkbv3", "rkbv3", "snapshots"} {
+		root := filepath.Join(dir, sub)
+		err := filepath.Walk(root,
+			func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					if os.IsNotExist(err) {
+						return nil
+					}
+					return err
+				}
+				if info.IsDir() {
+					return nil
+				}
+
+				data, err := ioutil.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				out, err := transform(filepath.Base(path), data)
+				if err != nil {
+					return fmt.Errorf("migrating %s: %v", path, err)
+				}
+				return writeFileAtomic(path, out)
+			})
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateEncrypt walks an existing, plaintext mdServerTlfStorage
+// directory for tlfID and encrypts every MD object, key bundle, and
+// snapshot file in place with cipher. It is meant to be run once, offline,
+// against a store that predates FileCipher.
+func migrateEncrypt(tlfID tlf.ID, dir string, cipher FileCipher) error {
+	return migrateTransform(dir, func(basename string, data []byte) ([]byte, error) {
+		return cipher.Encrypt(tlfID, basename, data)
+	})
+}
+
+// migrateDecrypt is the inverse of migrateEncrypt: it walks an
+// existing, encrypted mdServerTlfStorage directory for tlfID and
+// decrypts every MD object, key bundle, and snapshot file in place,
+// returning the store to cipher == nil's plaintext format.
+func migrateDecrypt(tlfID tlf.ID, dir string, cipher FileCipher) error {
+	return migrateTransform(dir, func(basename string, data []byte) ([]byte, error) {
+		return cipher.Decrypt(tlfID, basename, data)
+	})
+}
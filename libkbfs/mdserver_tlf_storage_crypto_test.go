@@ -0,0 +1,109 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+type cryptoTestPayload struct {
+	Data string
+}
+
+func TestAESGCMFileCipherRoundTrip(t *testing.T) {
+	var key [32]byte
+	key[0] = 1
+	cipher, err := NewAESGCMFileCipher(key)
+	require.NoError(t, err)
+
+	tlfID := tlf.FakeID(1, tlf.Private)
+	plaintext := []byte("some serialized RMDS bytes")
+
+	blob, err := cipher.Encrypt(tlfID, "deadbeef", plaintext)
+	require.NoError(t, err)
+	require.NotEqual(t, plaintext, blob)
+
+	decrypted, err := cipher.Decrypt(tlfID, "deadbeef", blob)
+	require.NoError(t, err)
+	require.Equal(t, plaintext, decrypted)
+}
+
+func TestAESGCMFileCipherAADMismatch(t *testing.T) {
+	var key [32]byte
+	key[0] = 1
+	cipher, err := NewAESGCMFileCipher(key)
+	require.NoError(t, err)
+
+	tlfID := tlf.FakeID(1, tlf.Private)
+	otherTlfID := tlf.FakeID(2, tlf.Private)
+	blob, err := cipher.Encrypt(tlfID, "deadbeef", []byte("plaintext"))
+	require.NoError(t, err)
+
+	// A blob moved to a different TLF's directory must not decrypt.
+	_, err = cipher.Decrypt(otherTlfID, "deadbeef", blob)
+	require.Error(t, err)
+
+	// Nor must a blob renamed to a different basename, e.g. copied
+	// from wkbv3 into rkbv3.
+	_, err = cipher.Decrypt(tlfID, "beefdead", blob)
+	require.Error(t, err)
+}
+
+func TestSerializeDeserializeFileMaybeEncryptedRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdserver_tlf_storage_crypto_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var key [32]byte
+	key[0] = 1
+	cipher, err := NewAESGCMFileCipher(key)
+	require.NoError(t, err)
+
+	codec := kbfscodec.NewMsgpackCodec()
+	tlfID := tlf.FakeID(1, tlf.Private)
+	path := filepath.Join(dir, "deadbeef")
+
+	obj := cryptoTestPayload{Data: "hello at-rest encryption"}
+	err = serializeToFileMaybeEncrypted(codec, cipher, tlfID, obj, path)
+	require.NoError(t, err)
+
+	// The bytes on disk must not be the plaintext codec encoding.
+	onDisk, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	plainEncoded, err := codec.Encode(obj)
+	require.NoError(t, err)
+	require.NotEqual(t, plainEncoded, onDisk)
+
+	var decoded cryptoTestPayload
+	err = deserializeFromFileMaybeEncrypted(codec, cipher, tlfID, path, &decoded)
+	require.NoError(t, err)
+	require.Equal(t, obj, decoded)
+}
+
+func TestSerializeDeserializeFileMaybeEncryptedNilCipher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdserver_tlf_storage_crypto_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	codec := kbfscodec.NewMsgpackCodec()
+	tlfID := tlf.FakeID(1, tlf.Private)
+	path := filepath.Join(dir, "deadbeef")
+
+	obj := cryptoTestPayload{Data: "plaintext store"}
+	err = serializeToFileMaybeEncrypted(codec, nil, tlfID, obj, path)
+	require.NoError(t, err)
+
+	var decoded cryptoTestPayload
+	err = deserializeFromFileMaybeEncrypted(codec, nil, tlfID, path, &decoded)
+	require.NoError(t, err)
+	require.Equal(t, obj, decoded)
+}
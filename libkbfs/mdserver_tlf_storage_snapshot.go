@@ -0,0 +1,293 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/keybase/kbfs/tlf"
+)
+
+// SnapshotID identifies a snapshot blob by the hash of its serialized
+// contents, the same way an MdID identifies a RootMetadataSigned.
+type SnapshotID struct {
+	h [sha256.Size]byte
+}
+
+// String implements the Stringer interface for SnapshotID.
+func (id SnapshotID) String() string {
+	return hex.EncodeToString(id.h[:])
+}
+
+// snapshotAncestor is one entry of a snapshotBlob's Ancestors list.
+type snapshotAncestor struct {
+	Rev MetadataRevision
+	ID  MdID
+}
+
+// snapshotBlob is the structure stored under dir/snapshots, keyed by
+// the hash of its own serialized bytes. It summarizes a branch's
+// history up to and including UpTo, so that Compact can safely delete
+// the MD files it covers and a client that gets ErrRevisionCompacted
+// can still learn what that deleted history looked like.
+type snapshotBlob struct {
+	TlfID              tlf.ID
+	Bid                BranchID
+	UpTo               MetadataRevision
+	HeadID             MdID
+	Ancestors          []snapshotAncestor
+	WriterKeyBundleIDs []TLFWriterKeyBundleID
+	ReaderKeyBundleIDs []TLFReaderKeyBundleID
+	Timestamp          time.Time
+}
+
+// snapshotStartRevision returns the oldest revision of bid that still
+// has an MD file on disk: 1 if bs has never been compacted, or
+// bs.compactedUpTo otherwise, since Compact deletes every MD file
+// strictly before that bound.
+func snapshotStartRevision(bs *branchJournalState) MetadataRevision {
+	if bs.compactedUpTo > MetadataRevision(1) {
+		return bs.compactedUpTo
+	}
+	return MetadataRevision(1)
+}
+
+// Snapshot writes a content-addressed summary of bid's history up to
+// and including upTo -- the head MdID at upTo, the full list of
+// (revision, MdID) ancestors back to the oldest revision still on
+// disk for bid, and the writer/reader key bundle IDs referenced along
+// the way -- to dir/snapshots, and returns its SnapshotID. Compact
+// takes the result and uses it to decide what it's safe to delete.
+func (s *mdServerTlfStorage) Snapshot(bid BranchID, upTo MetadataRevision) (
+	SnapshotID, error) {
+	if s.isShutdown() {
+		return SnapshotID{}, errMDServerTlfStorageShutdown
+	}
+
+	bs := s.getBranchState(bid)
+	if bs == nil {
+		return SnapshotID{}, fmt.Errorf(
+			"mdserver: no journal for branch %s", bid)
+	}
+
+	bs.lock.RLock()
+	defer bs.lock.RUnlock()
+
+	realStart, entries, err := bs.journal.getEntryRange(
+		snapshotStartRevision(bs), upTo)
+	if err != nil {
+		return SnapshotID{}, err
+	}
+	if len(entries) == 0 || realStart+MetadataRevision(len(entries)-1) != upTo {
+		return SnapshotID{}, fmt.Errorf(
+			"mdserver: revision %d not available for branch %s", upTo, bid)
+	}
+
+	ancestors := make([]snapshotAncestor, len(entries))
+	wkbIDs := make(map[TLFWriterKeyBundleID]bool)
+	rkbIDs := make(map[TLFReaderKeyBundleID]bool)
+	for i, entry := range entries {
+		ancestors[i] = snapshotAncestor{
+			Rev: realStart + MetadataRevision(i),
+			ID:  entry.ID,
+		}
+
+		rmds, err := s.getMD(entry.ID)
+		if err != nil {
+			return SnapshotID{}, err
+		}
+		if wkbID := rmds.MD.GetTLFWriterKeyBundleID(); wkbID != (TLFWriterKeyBundleID{}) {
+			wkbIDs[wkbID] = true
+		}
+		if rkbID := rmds.MD.GetTLFReaderKeyBundleID(); rkbID != (TLFReaderKeyBundleID{}) {
+			rkbIDs[rkbID] = true
+		}
+	}
+
+	blob := snapshotBlob{
+		TlfID:              s.tlfID,
+		Bid:                bid,
+		UpTo:               upTo,
+		HeadID:             ancestors[len(ancestors)-1].ID,
+		Ancestors:          ancestors,
+		WriterKeyBundleIDs: sortedWriterKeyBundleIDs(wkbIDs),
+		ReaderKeyBundleIDs: sortedReaderKeyBundleIDs(rkbIDs),
+		Timestamp:          s.clock.Now(),
+	}
+
+	encoded, err := s.codec.Encode(blob)
+	if err != nil {
+		return SnapshotID{}, err
+	}
+	id := SnapshotID{h: sha256.Sum256(encoded)}
+
+	stripe := s.fileStripe(id.String())
+	stripe.Lock()
+	defer stripe.Unlock()
+
+	err = serializeToFileMaybeEncrypted(
+		s.codec, s.cipher, s.tlfID, blob, s.snapshotPath(id))
+	if err != nil {
+		return SnapshotID{}, err
+	}
+
+	return id, nil
+}
+
+func sortedWriterKeyBundleIDs(ids map[TLFWriterKeyBundleID]bool) []TLFWriterKeyBundleID {
+	sorted := make([]TLFWriterKeyBundleID, 0, len(ids))
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].String() < sorted[j].String()
+	})
+	return sorted
+}
+
+func sortedReaderKeyBundleIDs(ids map[TLFReaderKeyBundleID]bool) []TLFReaderKeyBundleID {
+	sorted := make([]TLFReaderKeyBundleID, 0, len(ids))
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].String() < sorted[j].String()
+	})
+	return sorted
+}
+
+// Compact deletes every MD file on bid strictly older than snap's
+// UpTo revision, after verifying snap against its own content address
+// and confirming it's actually a snapshot of bid, then records UpTo
+// as bid's new compacted-up-to bound so getRangeReadLocked can turn a
+// read below it into ErrRevisionCompacted instead of failing to find
+// the now-deleted files. It refuses to delete anything that some
+// other branch's journal still references, since MD files (though
+// not journal entries) are shared across branches of the same TLF.
+//
+// Compact takes every branch's lock, in the same ascending lexical
+// BranchID.String() order put uses, because unlike put it must
+// inspect every other branch's journal, not just NullBranchID's.
+func (s *mdServerTlfStorage) Compact(bid BranchID, snap SnapshotID) error {
+	if s.isShutdown() {
+		return errMDServerTlfStorageShutdown
+	}
+
+	bs, err := s.getOrCreateBranchState(bid)
+	if err != nil {
+		return err
+	}
+
+	s.branchesLock.RLock()
+	type otherBranch struct {
+		bid BranchID
+		bs  *branchJournalState
+	}
+	others := make([]otherBranch, 0, len(s.branchJournals))
+	for otherBid, otherBS := range s.branchJournals {
+		if otherBid != bid {
+			others = append(others, otherBranch{otherBid, otherBS})
+		}
+	}
+	s.branchesLock.RUnlock()
+
+	sort.Slice(others, func(i, j int) bool {
+		return others[i].bid.String() < others[j].bid.String()
+	})
+
+	// Lock bid for writing and every other branch for reading, all in
+	// ascending lexical order of BranchID.String().
+	locked := false
+	for _, other := range others {
+		if !locked && bid.String() < other.bid.String() {
+			bs.lock.Lock()
+			defer bs.lock.Unlock()
+			locked = true
+		}
+		other.bs.lock.RLock()
+		defer other.bs.lock.RUnlock()
+	}
+	if !locked {
+		bs.lock.Lock()
+		defer bs.lock.Unlock()
+	}
+
+	var blob snapshotBlob
+	err = deserializeFromFileMaybeEncrypted(
+		s.codec, s.cipher, s.tlfID, s.snapshotPath(snap), &blob)
+	if err != nil {
+		return fmt.Errorf("mdserver: reading snapshot %s: %v", snap, err)
+	}
+
+	encoded, err := s.codec.Encode(blob)
+	if err != nil {
+		return err
+	}
+	if computedID := (SnapshotID{h: sha256.Sum256(encoded)}); computedID != snap {
+		return fmt.Errorf("mdserver: snapshot %s failed integrity check", snap)
+	}
+	if blob.TlfID != s.tlfID || blob.Bid != bid {
+		return fmt.Errorf(
+			"mdserver: snapshot %s is not a snapshot of branch %s", snap, bid)
+	}
+
+	toDelete := make([]snapshotAncestor, 0, len(blob.Ancestors))
+	toDeleteIDs := make(map[MdID]bool, len(blob.Ancestors))
+	for _, a := range blob.Ancestors {
+		if a.Rev < blob.UpTo {
+			toDelete = append(toDelete, a)
+			toDeleteIDs[a.ID] = true
+		}
+	}
+	if len(toDelete) == 0 {
+		return nil
+	}
+
+	for _, other := range others {
+		_, entries, err := other.bs.journal.getEntryRange(
+			MetadataRevision(1), MetadataRevision(math.MaxInt64))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if toDeleteIDs[entry.ID] {
+				return fmt.Errorf(
+					"mdserver: cannot compact branch %s: MdID %s is still "+
+						"referenced by branch %s", bid, entry.ID, other.bid)
+			}
+		}
+	}
+
+	keys := make([]string, len(toDelete))
+	for i, a := range toDelete {
+		keys[i] = a.ID.String()
+	}
+	unlock := s.lockFileStripesForWrite(keys...)
+	defer unlock()
+
+	for _, a := range toDelete {
+		if err := os.Remove(s.mdPath(a.ID)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("mdserver: deleting %s: %v", a.ID, err)
+		}
+	}
+
+	// mdIDJournal exposes no way to drop its earliest entries (only
+	// append, getLatestEntry, getEntryRange, and length), so bid's
+	// journal itself is left alone; bs.compactedUpTo is the only
+	// record that the on-disk MD files backing revisions before it
+	// are gone. getRangeReadLocked consults it to turn a read below
+	// that bound into ErrRevisionCompacted before it can reach
+	// getEntryRange and fail trying to getMD a deleted file.
+	bs.compactedUpTo = blob.UpTo
+	bs.compactionSnapshot = snap
+
+	return nil
+}